@@ -0,0 +1,171 @@
+package terraform
+
+import (
+	tfjson "github.com/hashicorp/terraform-json"
+
+	"github.com/mitchellh/mapstructure"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/provisionersdk/proto"
+)
+
+// findPlanDependencies walks a terraform plan's configuration module tree,
+// associating every resource address with the addresses in its explicit
+// depends_on list. Dependencies implied only by expression references are
+// not recorded. This follows `module_calls` directly instead of parsing
+// `terraform graph` output, so it stays correct across nested modules and
+// when two resources share a name in different modules.
+func findPlanDependencies(plan *tfjson.Plan) map[string][]string {
+	dependencies := map[string][]string{}
+	if plan.Config == nil || plan.Config.RootModule == nil {
+		return dependencies
+	}
+	walkConfigModule(plan.Config.RootModule, "", dependencies)
+	return dependencies
+}
+
+func walkConfigModule(module *tfjson.ConfigModule, addressPrefix string, dependencies map[string][]string) {
+	for _, resource := range module.Resources {
+		address := addressPrefix + resource.Address
+		deps := make([]string, 0, len(resource.DependsOn))
+		for _, dep := range resource.DependsOn {
+			deps = append(deps, addressPrefix+dep)
+		}
+		dependencies[address] = deps
+	}
+	for name, call := range module.ModuleCalls {
+		if call.Module == nil {
+			continue
+		}
+		walkConfigModule(call.Module, addressPrefix+"module."+name+".", dependencies)
+	}
+}
+
+// findStateDependencies does the same as findPlanDependencies, but from a
+// terraform state or planned-values module tree, whose resources already
+// carry fully-qualified addresses and resolved depends_on lists.
+func findStateDependencies(module *tfjson.StateModule) map[string][]string {
+	dependencies := map[string][]string{}
+	walkStateModule(module, func(resource *tfjson.StateResource) {
+		dependencies[resource.Address] = resource.DependsOn
+	})
+	return dependencies
+}
+
+// walkStateModule calls visit for every resource in module and its
+// descendant modules.
+func walkStateModule(module *tfjson.StateModule, visit func(*tfjson.StateResource)) {
+	if module == nil {
+		return
+	}
+	for _, resource := range module.Resources {
+		visit(resource)
+	}
+	for _, child := range module.ChildModules {
+		walkStateModule(child, visit)
+	}
+}
+
+// findConfigAgents walks a terraform configuration module tree, returning a
+// coder_agent resource for every address at which one is declared. It can
+// only populate the fields that are statically known at configuration time;
+// findStateAgents fills in the rest once state exists.
+func findConfigAgents(module *tfjson.ConfigModule, addressPrefix string, agents map[string]*proto.Agent) {
+	for _, resource := range module.Resources {
+		if resource.Type != "coder_agent" {
+			continue
+		}
+		agent := &proto.Agent{
+			Auth: &proto.Agent_Token{},
+		}
+		if envRaw, has := resource.Expressions["env"]; has {
+			env, ok := envRaw.ConstantValue.(map[string]string)
+			if ok {
+				agent.Env = env
+			}
+		}
+		if startupScriptRaw, has := resource.Expressions["startup_script"]; has {
+			startupScript, ok := startupScriptRaw.ConstantValue.(string)
+			if ok {
+				agent.StartupScript = startupScript
+			}
+		}
+		if _, has := resource.Expressions["instance_id"]; has {
+			// This is a dynamic value. If it's expressed, we know
+			// it's at least an instance ID, which is better than nothing.
+			agent.Auth = &proto.Agent_InstanceId{
+				InstanceId: "",
+			}
+		}
+		agents[addressPrefix+resource.Address] = agent
+	}
+	for name, call := range module.ModuleCalls {
+		if call.Module == nil {
+			continue
+		}
+		findConfigAgents(call.Module, addressPrefix+"module."+name+".", agents)
+	}
+}
+
+// findStateAgents does the same as findConfigAgents, but reads the resolved
+// attribute values out of a terraform state or planned-values module tree.
+func findStateAgents(module *tfjson.StateModule, agents map[string]*proto.Agent) error {
+	type agentAttributes struct {
+		ID            string            `mapstructure:"id"`
+		Token         string            `mapstructure:"token"`
+		InstanceID    string            `mapstructure:"instance_id"`
+		Env           map[string]string `mapstructure:"env"`
+		StartupScript string            `mapstructure:"startup_script"`
+	}
+	var decodeErr error
+	walkStateModule(module, func(resource *tfjson.StateResource) {
+		if decodeErr != nil || resource.Type != "coder_agent" {
+			return
+		}
+		var attrs agentAttributes
+		err := mapstructure.Decode(resource.AttributeValues, &attrs)
+		if err != nil {
+			decodeErr = xerrors.Errorf("decode agent attributes: %w", err)
+			return
+		}
+		agent := &proto.Agent{
+			Id:            attrs.ID,
+			Env:           attrs.Env,
+			StartupScript: attrs.StartupScript,
+			Auth: &proto.Agent_Token{
+				Token: attrs.Token,
+			},
+		}
+		if attrs.InstanceID != "" {
+			agent.Auth = &proto.Agent_InstanceId{
+				InstanceId: attrs.InstanceID,
+			}
+		}
+		agents[resource.Address] = agent
+	})
+	return decodeErr
+}
+
+// appendResources walks a terraform state or planned-values module tree,
+// appending every non-agent resource to *resources with its associated
+// agent resolved via dependencies and agents.
+func appendResources(module *tfjson.StateModule, dependencies map[string][]string, agents map[string]*proto.Agent, resources *[]*proto.Resource) {
+	walkStateModule(module, func(resource *tfjson.StateResource) {
+		if resource.Type == "coder_agent" {
+			return
+		}
+		var agent *proto.Agent
+		for _, dep := range dependencies[resource.Address] {
+			var has bool
+			agent, has = agents[dep]
+			if has {
+				break
+			}
+		}
+		*resources = append(*resources, &proto.Resource{
+			Name:  resource.Name,
+			Type:  resource.Type,
+			Agent: agent,
+		})
+	})
+}
@@ -0,0 +1,173 @@
+package terraform
+
+import (
+	"testing"
+
+	tfjson "github.com/hashicorp/terraform-json"
+
+	"github.com/coder/coder/provisionersdk/proto"
+)
+
+func TestFindPlanDependencies(t *testing.T) {
+	t.Parallel()
+
+	t.Run("NestedModuleCall", func(t *testing.T) {
+		t.Parallel()
+		plan := &tfjson.Plan{
+			Config: &tfjson.Config{
+				RootModule: &tfjson.ConfigModule{
+					Resources: []*tfjson.ConfigResource{
+						{
+							Address:   "null_resource.example",
+							Type:      "null_resource",
+							DependsOn: []string{"module.compute.coder_agent.dev"},
+						},
+					},
+					ModuleCalls: map[string]*tfjson.ModuleCall{
+						"compute": {
+							Module: &tfjson.ConfigModule{
+								Resources: []*tfjson.ConfigResource{
+									{Address: "coder_agent.dev", Type: "coder_agent"},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		dependencies := findPlanDependencies(plan)
+
+		deps, ok := dependencies["null_resource.example"]
+		if !ok {
+			t.Fatal("expected a dependency entry for null_resource.example")
+		}
+		if len(deps) != 1 || deps[0] != "module.compute.coder_agent.dev" {
+			t.Fatalf("expected null_resource.example to depend on module.compute.coder_agent.dev, got %v", deps)
+		}
+		if _, ok := dependencies["module.compute.coder_agent.dev"]; !ok {
+			t.Fatal("expected a dependency entry for the nested module's coder_agent.dev")
+		}
+	})
+
+	t.Run("SameResourceNameInDifferentModules", func(t *testing.T) {
+		t.Parallel()
+		plan := &tfjson.Plan{
+			Config: &tfjson.Config{
+				RootModule: &tfjson.ConfigModule{
+					ModuleCalls: map[string]*tfjson.ModuleCall{
+						"a": {
+							Module: &tfjson.ConfigModule{
+								Resources: []*tfjson.ConfigResource{
+									{Address: "null_resource.example", DependsOn: []string{"coder_agent.dev"}},
+									{Address: "coder_agent.dev", Type: "coder_agent"},
+								},
+							},
+						},
+						"b": {
+							Module: &tfjson.ConfigModule{
+								Resources: []*tfjson.ConfigResource{
+									{Address: "null_resource.example"},
+									{Address: "coder_agent.dev", Type: "coder_agent"},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		dependencies := findPlanDependencies(plan)
+
+		aDeps, ok := dependencies["module.a.null_resource.example"]
+		if !ok {
+			t.Fatal("expected a dependency entry for module.a.null_resource.example")
+		}
+		if len(aDeps) != 1 || aDeps[0] != "module.a.coder_agent.dev" {
+			t.Fatalf("expected module.a.null_resource.example to depend on module.a.coder_agent.dev, got %v", aDeps)
+		}
+		bDeps, ok := dependencies["module.b.null_resource.example"]
+		if !ok {
+			t.Fatal("expected a dependency entry for module.b.null_resource.example")
+		}
+		if len(bDeps) != 0 {
+			t.Fatalf("expected module.b.null_resource.example to have no dependencies, got %v", bDeps)
+		}
+	})
+}
+
+func TestAppendResourcesSameNameDifferentModules(t *testing.T) {
+	t.Parallel()
+
+	// Two child modules each declare a coder_agent and a resource that
+	// depends on it. Resolving dependencies by fully-qualified address
+	// should attach each resource to its own module's agent, never the
+	// other module's same-named one.
+	root := &tfjson.StateModule{
+		ChildModules: []*tfjson.StateModule{
+			{
+				Address: "module.a",
+				Resources: []*tfjson.StateResource{
+					{
+						Address:         "module.a.coder_agent.dev",
+						Type:            "coder_agent",
+						Name:            "dev",
+						AttributeValues: map[string]interface{}{"id": "agent-a", "token": "token-a"},
+					},
+					{
+						Address:   "module.a.null_resource.example",
+						Type:      "null_resource",
+						Name:      "example",
+						DependsOn: []string{"module.a.coder_agent.dev"},
+					},
+				},
+			},
+			{
+				Address: "module.b",
+				Resources: []*tfjson.StateResource{
+					{
+						Address:         "module.b.coder_agent.dev",
+						Type:            "coder_agent",
+						Name:            "dev",
+						AttributeValues: map[string]interface{}{"id": "agent-b", "token": "token-b"},
+					},
+					{
+						Address:   "module.b.null_resource.example",
+						Type:      "null_resource",
+						Name:      "example",
+						DependsOn: []string{"module.b.coder_agent.dev"},
+					},
+				},
+			},
+		},
+	}
+
+	dependencies := findStateDependencies(root)
+	agents := map[string]*proto.Agent{}
+	if err := findStateAgents(root, agents); err != nil {
+		t.Fatalf("findStateAgents: %v", err)
+	}
+
+	var resources []*proto.Resource
+	appendResources(root, dependencies, agents, &resources)
+
+	if len(resources) != 2 {
+		t.Fatalf("expected 2 non-agent resources, got %d", len(resources))
+	}
+	for _, resource := range resources {
+		if resource.Agent == nil {
+			t.Fatalf("resource %q: expected an agent to be resolved", resource.Name)
+		}
+	}
+
+	byID := map[string]*proto.Resource{}
+	for _, resource := range resources {
+		byID[resource.Agent.Id] = resource
+	}
+	if _, ok := byID["agent-a"]; !ok {
+		t.Fatal("expected a resource attached to agent-a")
+	}
+	if _, ok := byID["agent-b"]; !ok {
+		t.Fatal("expected a resource attached to agent-b")
+	}
+}
@@ -0,0 +1,132 @@
+package terraform
+
+import (
+	"encoding/json"
+
+	tfjson "github.com/hashicorp/terraform-json"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/provisionersdk/proto"
+)
+
+const sensitiveValuePlaceholder = "(sensitive value)"
+
+// convertPlannedChanges builds the per-resource diff the Coder UI renders
+// as a Terraform-style plan summary, redacting any attribute terraform
+// itself flagged as sensitive.
+func convertPlannedChanges(plan *tfjson.Plan) ([]*proto.PlannedChange, error) {
+	changes := make([]*proto.PlannedChange, 0, len(plan.ResourceChanges))
+	for _, resourceChange := range plan.ResourceChanges {
+		before, err := redactedJSON(resourceChange.Change.Before, resourceChange.Change.BeforeSensitive)
+		if err != nil {
+			return nil, xerrors.Errorf("redact before state for %q: %w", resourceChange.Address, err)
+		}
+		after, err := redactedJSON(resourceChange.Change.After, resourceChange.Change.AfterSensitive)
+		if err != nil {
+			return nil, xerrors.Errorf("redact after state for %q: %w", resourceChange.Address, err)
+		}
+		changes = append(changes, &proto.PlannedChange{
+			Address: resourceChange.Address,
+			Action:  convertChangeAction(resourceChange.Change.Actions),
+			Before:  before,
+			After:   after,
+		})
+	}
+	return changes, nil
+}
+
+// convertOutputChanges reports which root module outputs a plan would add,
+// change, or remove.
+func convertOutputChanges(plan *tfjson.Plan) []*proto.OutputChange {
+	changes := make([]*proto.OutputChange, 0, len(plan.OutputChanges))
+	for name, change := range plan.OutputChanges {
+		changes = append(changes, &proto.OutputChange{
+			Name:   name,
+			Action: convertChangeAction(change.Actions),
+		})
+	}
+	return changes
+}
+
+// summarizePlannedChanges counts how many resources a plan would create,
+// update, or destroy. A replace counts toward both add and destroy, the
+// same way terraform's own CLI summary reports it.
+func summarizePlannedChanges(plan *tfjson.Plan) *proto.ChangeSummary {
+	summary := &proto.ChangeSummary{}
+	for _, resourceChange := range plan.ResourceChanges {
+		actions := resourceChange.Change.Actions
+		if actions.Create() || actions.Replace() {
+			summary.Add++
+		}
+		if actions.Delete() || actions.Replace() {
+			summary.Destroy++
+		}
+		if actions.Update() {
+			summary.Change++
+		}
+	}
+	return summary
+}
+
+func convertChangeAction(actions tfjson.Actions) string {
+	switch {
+	case actions.Replace():
+		return "replace"
+	case actions.Create():
+		return "create"
+	case actions.Update():
+		return "update"
+	case actions.Delete():
+		return "delete"
+	default:
+		return "no-op"
+	}
+}
+
+// redactedJSON JSON-encodes value after replacing every attribute marked
+// sensitive (per sensitive, which mirrors value's shape with bools or
+// nested maps in place of leaf values) with a placeholder.
+func redactedJSON(value, sensitive interface{}) (string, error) {
+	encoded, err := json.Marshal(redactSensitive(value, sensitive))
+	if err != nil {
+		return "", xerrors.Errorf("marshal redacted value: %w", err)
+	}
+	return string(encoded), nil
+}
+
+func redactSensitive(value, sensitive interface{}) interface{} {
+	if isSensitive, ok := sensitive.(bool); ok && isSensitive {
+		return sensitiveValuePlaceholder
+	}
+	if sensitiveSlice, ok := sensitive.([]interface{}); ok {
+		// Terraform marks per-element sensitivity on list/set/tuple
+		// attributes as a slice parallel to the value, rather than a single
+		// bool covering the whole attribute.
+		valueSlice, ok := value.([]interface{})
+		if !ok {
+			return value
+		}
+		redacted := make([]interface{}, len(valueSlice))
+		for i, v := range valueSlice {
+			var elementSensitive interface{}
+			if i < len(sensitiveSlice) {
+				elementSensitive = sensitiveSlice[i]
+			}
+			redacted[i] = redactSensitive(v, elementSensitive)
+		}
+		return redacted
+	}
+	sensitiveMap, ok := sensitive.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	valueMap, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	redacted := make(map[string]interface{}, len(valueMap))
+	for key, v := range valueMap {
+		redacted[key] = redactSensitive(v, sensitiveMap[key])
+	}
+	return redacted
+}
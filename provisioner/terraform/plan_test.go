@@ -0,0 +1,63 @@
+package terraform
+
+import (
+	"testing"
+)
+
+func TestRedactSensitive(t *testing.T) {
+	t.Parallel()
+
+	t.Run("TopLevelBool", func(t *testing.T) {
+		t.Parallel()
+		got := redactSensitive("secret", true)
+		if got != sensitiveValuePlaceholder {
+			t.Fatalf("got %v, want %v", got, sensitiveValuePlaceholder)
+		}
+	})
+
+	t.Run("NestedMap", func(t *testing.T) {
+		t.Parallel()
+		value := map[string]interface{}{
+			"username": "alice",
+			"password": "hunter2",
+		}
+		sensitive := map[string]interface{}{
+			"password": true,
+		}
+		got := redactSensitive(value, sensitive).(map[string]interface{})
+		if got["username"] != "alice" {
+			t.Fatalf("username was redacted: %v", got["username"])
+		}
+		if got["password"] != sensitiveValuePlaceholder {
+			t.Fatalf("password was not redacted: %v", got["password"])
+		}
+	})
+
+	t.Run("ListWithSensitiveElement", func(t *testing.T) {
+		t.Parallel()
+		value := []interface{}{"public", "hunter2", "also-public"}
+		sensitive := []interface{}{false, true, false}
+		got := redactSensitive(value, sensitive).([]interface{})
+		want := []interface{}{"public", sensitiveValuePlaceholder, "also-public"}
+		for i, v := range want {
+			if got[i] != v {
+				t.Fatalf("element %d: got %v, want %v", i, got[i], v)
+			}
+		}
+	})
+
+	t.Run("ListOfMapsWithSensitiveElement", func(t *testing.T) {
+		t.Parallel()
+		value := []interface{}{
+			map[string]interface{}{"token": "abc123"},
+		}
+		sensitive := []interface{}{
+			map[string]interface{}{"token": true},
+		}
+		got := redactSensitive(value, sensitive).([]interface{})
+		element := got[0].(map[string]interface{})
+		if element["token"] != sensitiveValuePlaceholder {
+			t.Fatalf("token was not redacted: %v", element["token"])
+		}
+	})
+}
@@ -11,9 +11,7 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/awalterschulze/gographviz"
 	"github.com/hashicorp/terraform-exec/tfexec"
-	"github.com/mitchellh/mapstructure"
 	"golang.org/x/xerrors"
 
 	"github.com/coder/coder/provisionersdk"
@@ -36,29 +34,74 @@ func (t *terraform) Provision(stream proto.DRPCProvisioner_ProvisionStream) erro
 	if request.GetStart() == nil {
 		return nil
 	}
+	// stateResponses and lockGrants are fed by the single goroutine below
+	// that reads stream.Recv() for the lifetime of the call, so a
+	// stream-backed StateBackend never has to race it for incoming
+	// messages.
+	stateResponses := make(chan *proto.StateResponse)
+	lockGrants := make(chan *proto.LockResponse)
 	go func() {
+		defer close(stateResponses)
+		defer close(lockGrants)
 		for {
 			request, err := stream.Recv()
 			if err != nil {
 				return
 			}
-			if request.GetCancel() == nil {
-				// This is only to process cancels!
-				continue
+			if request.GetCancel() != nil {
+				shutdownFunc()
+				return
+			}
+			if response := request.GetState(); response != nil {
+				select {
+				case stateResponses <- response:
+				case <-shutdown.Done():
+					return
+				}
+			}
+			if grant := request.GetLock(); grant != nil {
+				select {
+				case lockGrants <- grant:
+				case <-shutdown.Done():
+					return
+				}
 			}
-			shutdownFunc()
-			return
 		}
 	}()
 	start := request.GetStart()
+	workspaceID := start.Metadata.WorkspaceId
+
+	stateBackend := t.stateBackend
+	if t.streamState {
+		stateBackend = NewStreamStateBackend(stream, stateResponses, lockGrants)
+	}
+
+	unlock, err := stateBackend.Lock(shutdown, workspaceID)
+	if err != nil {
+		return xerrors.Errorf("lock workspace state: %w", err)
+	}
+	defer unlock()
+
 	statefilePath := filepath.Join(start.Directory, "terraform.tfstate")
-	if len(start.State) > 0 {
-		err := os.WriteFile(statefilePath, start.State, 0600)
+	state := start.State
+	if len(state) == 0 {
+		state, err = stateBackend.Load(shutdown, workspaceID)
+		if err != nil {
+			return xerrors.Errorf("load state: %w", err)
+		}
+	}
+	if len(state) > 0 {
+		err := os.WriteFile(statefilePath, state, 0600)
 		if err != nil {
 			return xerrors.Errorf("write statefile %q: %w", statefilePath, err)
 		}
 	}
 
+	err = writeInlineModuleSource(start.Directory, start.ModuleSource, start.ModuleSourceType)
+	if err != nil {
+		return xerrors.Errorf("write inline module: %w", err)
+	}
+
 	terraform, err := tfexec.NewTerraform(start.Directory, t.binaryPath)
 	if err != nil {
 		return xerrors.Errorf("create new terraform executor: %w", err)
@@ -96,8 +139,9 @@ func (t *terraform) Provision(stream proto.DRPCProvisioner_ProvisionStream) erro
 		}
 	}
 	terraform.SetStdout(writer)
+	initOptions := terraformInitOptions(start.ModuleSource, start.ModuleSourceType)
 	t.logger.Debug(shutdown, "running initialization")
-	err = terraform.Init(shutdown)
+	err = terraform.Init(shutdown, initOptions...)
 	if err != nil {
 		return xerrors.Errorf("initialize terraform: %w", err)
 	}
@@ -131,6 +175,7 @@ func (t *terraform) Provision(stream proto.DRPCProvisioner_ProvisionStream) erro
 	reader, writer = io.Pipe()
 	defer reader.Close()
 	defer writer.Close()
+	var diagnostics []*proto.Diagnostic
 	go func() {
 		defer close(closeChan)
 		decoder := json.NewDecoder(reader)
@@ -154,23 +199,51 @@ func (t *terraform) Provision(stream proto.DRPCProvisioner_ProvisionStream) erro
 				},
 			})
 
-			if log.Diagnostic == nil {
+			if log.Diagnostic != nil {
+				// If the diagnostic is provided, send it as its own
+				// structured message instead of collapsing it into a log
+				// line, so the source location and snippet survive the
+				// trip to the caller.
+				diagnostic := convertTerraformDiagnostic(log.Diagnostic)
+				diagnostics = append(diagnostics, diagnostic)
+				_ = stream.Send(&proto.Provision_Response{
+					Type: &proto.Provision_Response_Diagnostic{
+						Diagnostic: diagnostic,
+					},
+				})
 				continue
 			}
 
-			// If the diagnostic is provided, let's provide a bit more info!
-			logLevel, err = convertTerraformLogLevel(log.Diagnostic.Severity)
-			if err != nil {
+			if log.Hook != nil {
+				// apply_start, apply_progress, apply_complete,
+				// apply_errored, and refresh_start all carry a resource
+				// hook; every
+				// apply_start is matched by exactly one apply_complete or
+				// apply_errored for the same address.
+				_ = stream.Send(&proto.Provision_Response{
+					Type: &proto.Provision_Response_ResourceProgress{
+						ResourceProgress: &proto.ResourceProgress{
+							Address:        log.Hook.Resource.Addr,
+							Action:         log.Hook.Action,
+							Stage:          convertTerraformApplyStage(log.Type),
+							ElapsedSeconds: log.Hook.ElapsedSeconds,
+						},
+					},
+				})
 				continue
 			}
-			_ = stream.Send(&proto.Provision_Response{
-				Type: &proto.Provision_Response_Log{
-					Log: &proto.Log{
-						Level:  logLevel,
-						Output: log.Diagnostic.Detail,
+
+			if log.Changes != nil {
+				_ = stream.Send(&proto.Provision_Response{
+					Type: &proto.Provision_Response_ChangeSummary{
+						ChangeSummary: &proto.ChangeSummary{
+							Add:     int32(log.Changes.Add),
+							Change:  int32(log.Changes.Change),
+							Destroy: int32(log.Changes.Remove),
+						},
 					},
-				},
-			})
+				})
+			}
 		}
 	}()
 
@@ -216,17 +289,25 @@ func (t *terraform) Provision(stream proto.DRPCProvisioner_ProvisionStream) erro
 	cmd.Dir = terraform.WorkingDir()
 	err = cmd.Run()
 	if err != nil {
+		// Drain the remaining terraform output so the diagnostics we
+		// attach to Complete below reflect everything terraform reported,
+		// not just what had been decoded by the time the process exited.
+		_ = reader.Close()
+		<-closeChan
 		if start.DryRun {
-			if shutdown.Err() != nil {
-				return stream.Send(&proto.Provision_Response{
-					Type: &proto.Provision_Response_Complete{
-						Complete: &proto.Provision_Complete{
-							Error: err.Error(),
-						},
+			// Whether terraform failed because of a cancellation or for an
+			// ordinary reason (an HCL error, say), send back what we
+			// collected so far as a structured Complete instead of a bare
+			// transport error, so diagnostics survive the trip to the
+			// caller.
+			return stream.Send(&proto.Provision_Response{
+				Type: &proto.Provision_Response_Complete{
+					Complete: &proto.Provision_Complete{
+						Error:       err.Error(),
+						Diagnostics: diagnostics,
 					},
-				})
-			}
-			return xerrors.Errorf("plan terraform: %w", err)
+				},
+			})
 		}
 		errorMessage := err.Error()
 		// Terraform can fail and apply and still need to store it's state.
@@ -235,11 +316,16 @@ func (t *terraform) Provision(stream proto.DRPCProvisioner_ProvisionStream) erro
 		if err != nil {
 			return xerrors.Errorf("read file %q: %w", statefilePath, err)
 		}
+		err = stateBackend.Save(shutdown, workspaceID, statefileContent)
+		if err != nil {
+			return xerrors.Errorf("save state: %w", err)
+		}
 		return stream.Send(&proto.Provision_Response{
 			Type: &proto.Provision_Response_Complete{
 				Complete: &proto.Provision_Complete{
-					State: statefileContent,
-					Error: errorMessage,
+					State:       statefileContent,
+					Error:       errorMessage,
+					Diagnostics: diagnostics,
 				},
 			},
 		})
@@ -252,6 +338,9 @@ func (t *terraform) Provision(stream proto.DRPCProvisioner_ProvisionStream) erro
 		resp, err = parseTerraformPlan(stream.Context(), terraform, planfilePath)
 	} else {
 		resp, err = parseTerraformApply(stream.Context(), terraform, statefilePath)
+		if err == nil {
+			err = stateBackend.Save(shutdown, workspaceID, resp.GetComplete().State)
+		}
 	}
 	if err != nil {
 		return err
@@ -259,84 +348,57 @@ func (t *terraform) Provision(stream proto.DRPCProvisioner_ProvisionStream) erro
 	return stream.Send(resp)
 }
 
+// writeInlineModuleSource writes source into directory as main.tf if
+// sourceType is an inline module, so it's in place before terraform init
+// ever runs. It's a no-op for every other source type, including the zero
+// value, since a module pre-staged in directory needs nothing extra written.
+func writeInlineModuleSource(directory, source string, sourceType proto.ModuleSourceType) error {
+	if source == "" || sourceType != proto.ModuleSourceType_Inline {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(directory, "main.tf"), []byte(source), 0600)
+}
+
+// terraformInitOptions builds the tfexec.InitOption list for source and
+// sourceType. A remote source (a git URL, an S3 bucket, a registry module,
+// ...) is pulled straight from its origin via `-from-module` instead of
+// requiring it to be pre-staged in the working directory.
+func terraformInitOptions(source string, sourceType proto.ModuleSourceType) []tfexec.InitOption {
+	if source == "" || sourceType != proto.ModuleSourceType_Remote {
+		return nil
+	}
+	return []tfexec.InitOption{tfexec.FromModule(source)}
+}
+
 func parseTerraformPlan(ctx context.Context, terraform *tfexec.Terraform, planfilePath string) (*proto.Provision_Response, error) {
 	plan, err := terraform.ShowPlanFile(ctx, planfilePath)
 	if err != nil {
 		return nil, xerrors.Errorf("show terraform plan file: %w", err)
 	}
 
-	rawGraph, err := terraform.Graph(ctx)
-	if err != nil {
-		return nil, xerrors.Errorf("graph: %w", err)
-	}
-	resourceDependencies, err := findDirectDependencies(rawGraph)
-	if err != nil {
-		return nil, xerrors.Errorf("find dependencies: %w", err)
+	resourceDependencies := findPlanDependencies(plan)
+	agents := map[string]*proto.Agent{}
+	if plan.Config != nil && plan.Config.RootModule != nil {
+		findConfigAgents(plan.Config.RootModule, "", agents)
 	}
 
 	resources := make([]*proto.Resource, 0)
-	agents := map[string]*proto.Agent{}
-
-	// Store all agents inside the maps!
-	for _, resource := range plan.Config.RootModule.Resources {
-		if resource.Type != "coder_agent" {
-			continue
-		}
-		agent := &proto.Agent{
-			Auth: &proto.Agent_Token{},
-		}
-		if envRaw, has := resource.Expressions["env"]; has {
-			env, ok := envRaw.ConstantValue.(map[string]string)
-			if ok {
-				agent.Env = env
-			}
-		}
-		if startupScriptRaw, has := resource.Expressions["startup_script"]; has {
-			startupScript, ok := startupScriptRaw.ConstantValue.(string)
-			if ok {
-				agent.StartupScript = startupScript
-			}
-		}
-		if _, has := resource.Expressions["instance_id"]; has {
-			// This is a dynamic value. If it's expressed, we know
-			// it's at least an instance ID, which is better than nothing.
-			agent.Auth = &proto.Agent_InstanceId{
-				InstanceId: "",
-			}
-		}
-
-		agents[resource.Address] = agent
+	if plan.PlannedValues != nil {
+		appendResources(plan.PlannedValues.RootModule, resourceDependencies, agents, &resources)
 	}
-	for _, resource := range plan.PlannedValues.RootModule.Resources {
-		if resource.Type == "coder_agent" {
-			continue
-		}
-		resourceKey := strings.Join([]string{resource.Type, resource.Name}, ".")
-		resourceNode, exists := resourceDependencies[resourceKey]
-		if !exists {
-			continue
-		}
-		// Associate resources that depend on an agent.
-		var agent *proto.Agent
-		for _, dep := range resourceNode {
-			var has bool
-			agent, has = agents[dep]
-			if has {
-				break
-			}
-		}
 
-		resources = append(resources, &proto.Resource{
-			Name:  resource.Name,
-			Type:  resource.Type,
-			Agent: agent,
-		})
+	plannedChanges, err := convertPlannedChanges(plan)
+	if err != nil {
+		return nil, xerrors.Errorf("convert planned changes: %w", err)
 	}
 
 	return &proto.Provision_Response{
 		Type: &proto.Provision_Response_Complete{
 			Complete: &proto.Provision_Complete{
-				Resources: resources,
+				Resources:      resources,
+				PlannedChanges: plannedChanges,
+				OutputChanges:  convertOutputChanges(plan),
+				ChangeSummary:  summarizePlannedChanges(plan),
 			},
 		},
 	}, nil
@@ -353,75 +415,13 @@ func parseTerraformApply(ctx context.Context, terraform *tfexec.Terraform, state
 	}
 	resources := make([]*proto.Resource, 0)
 	if state.Values != nil {
-		rawGraph, err := terraform.Graph(ctx)
-		if err != nil {
-			return nil, xerrors.Errorf("graph: %w", err)
-		}
-		resourceDependencies, err := findDirectDependencies(rawGraph)
-		if err != nil {
-			return nil, xerrors.Errorf("find dependencies: %w", err)
-		}
-		type agentAttributes struct {
-			ID            string            `mapstructure:"id"`
-			Token         string            `mapstructure:"token"`
-			InstanceID    string            `mapstructure:"instance_id"`
-			Env           map[string]string `mapstructure:"env"`
-			StartupScript string            `mapstructure:"startup_script"`
-		}
+		resourceDependencies := findStateDependencies(state.Values.RootModule)
 		agents := map[string]*proto.Agent{}
-
-		// Store all agents inside the maps!
-		for _, resource := range state.Values.RootModule.Resources {
-			if resource.Type != "coder_agent" {
-				continue
-			}
-			var attrs agentAttributes
-			err = mapstructure.Decode(resource.AttributeValues, &attrs)
-			if err != nil {
-				return nil, xerrors.Errorf("decode agent attributes: %w", err)
-			}
-			agent := &proto.Agent{
-				Id:            attrs.ID,
-				Env:           attrs.Env,
-				StartupScript: attrs.StartupScript,
-				Auth: &proto.Agent_Token{
-					Token: attrs.Token,
-				},
-			}
-			if attrs.InstanceID != "" {
-				agent.Auth = &proto.Agent_InstanceId{
-					InstanceId: attrs.InstanceID,
-				}
-			}
-			resourceKey := strings.Join([]string{resource.Type, resource.Name}, ".")
-			agents[resourceKey] = agent
-		}
-
-		for _, resource := range state.Values.RootModule.Resources {
-			if resource.Type == "coder_agent" {
-				continue
-			}
-			resourceKey := strings.Join([]string{resource.Type, resource.Name}, ".")
-			resourceNode, exists := resourceDependencies[resourceKey]
-			if !exists {
-				continue
-			}
-			// Associate resources that depend on an agent.
-			var agent *proto.Agent
-			for _, dep := range resourceNode {
-				var has bool
-				agent, has = agents[dep]
-				if has {
-					break
-				}
-			}
-
-			resources = append(resources, &proto.Resource{
-				Name:  resource.Name,
-				Type:  resource.Type,
-				Agent: agent,
-			})
+		err = findStateAgents(state.Values.RootModule, agents)
+		if err != nil {
+			return nil, err
 		}
+		appendResources(state.Values.RootModule, resourceDependencies, agents, &resources)
 	}
 
 	return &proto.Provision_Response{
@@ -439,12 +439,91 @@ type terraformProvisionLog struct {
 	Message string `json:"@message"`
 
 	Diagnostic *terraformProvisionLogDiagnostic `json:"diagnostic"`
+
+	// Type and the fields below are only present on the structured event
+	// types terraform apply -json emits alongside the plain log lines
+	// above: planned_change, apply_start, apply_progress, apply_complete,
+	// apply_errored, refresh_start, and change_summary.
+	Type    string                        `json:"type"`
+	Hook    *terraformProvisionLogHook    `json:"hook"`
+	Changes *terraformProvisionLogChanges `json:"changes"`
+}
+
+type terraformProvisionLogHook struct {
+	Resource       terraformProvisionLogHookResource `json:"resource"`
+	Action         string                            `json:"action"`
+	ElapsedSeconds float64                           `json:"elapsed_seconds"`
+}
+
+type terraformProvisionLogHookResource struct {
+	Addr string `json:"addr"`
+}
+
+type terraformProvisionLogChanges struct {
+	Add    int `json:"add"`
+	Change int `json:"change"`
+	Remove int `json:"remove"`
+}
+
+// convertTerraformApplyStage maps a terraform apply -json event type to the
+// coarser stage we report on ResourceProgress.
+func convertTerraformApplyStage(logType string) string {
+	switch logType {
+	case "apply_start", "refresh_start":
+		return "start"
+	case "apply_progress":
+		return "progress"
+	case "apply_complete":
+		return "complete"
+	case "apply_errored":
+		return "errored"
+	default:
+		return "unknown"
+	}
 }
 
 type terraformProvisionLogDiagnostic struct {
-	Severity string `json:"severity"`
-	Summary  string `json:"summary"`
-	Detail   string `json:"detail"`
+	Severity string                                  `json:"severity"`
+	Summary  string                                  `json:"summary"`
+	Detail   string                                  `json:"detail"`
+	Range    *terraformProvisionLogDiagnosticRange   `json:"range"`
+	Snippet  *terraformProvisionLogDiagnosticSnippet `json:"snippet"`
+}
+
+type terraformProvisionLogDiagnosticRange struct {
+	Filename string                             `json:"filename"`
+	Start    terraformProvisionLogDiagnosticPos `json:"start"`
+	End      terraformProvisionLogDiagnosticPos `json:"end"`
+}
+
+type terraformProvisionLogDiagnosticPos struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type terraformProvisionLogDiagnosticSnippet struct {
+	Context string `json:"context"`
+	Code    string `json:"code"`
+}
+
+// convertTerraformDiagnostic turns a raw terraform JSON diagnostic into the
+// structured form sent over the wire, preserving the source location and
+// snippet so callers can render it the way `terraform` itself does.
+func convertTerraformDiagnostic(diagnostic *terraformProvisionLogDiagnostic) *proto.Diagnostic {
+	converted := &proto.Diagnostic{
+		Severity: diagnostic.Severity,
+		Summary:  diagnostic.Summary,
+		Detail:   diagnostic.Detail,
+	}
+	if diagnostic.Range != nil {
+		converted.Filename = diagnostic.Range.Filename
+		converted.Line = int32(diagnostic.Range.Start.Line)
+		converted.Column = int32(diagnostic.Range.Start.Column)
+	}
+	if diagnostic.Snippet != nil {
+		converted.Snippet = diagnostic.Snippet.Context
+	}
+	return converted
 }
 
 func convertTerraformLogLevel(logLevel string) (proto.LogLevel, error) {
@@ -463,46 +542,3 @@ func convertTerraformLogLevel(logLevel string) (proto.LogLevel, error) {
 		return proto.LogLevel(0), xerrors.Errorf("invalid log level %q", logLevel)
 	}
 }
-
-// findDirectDependencies maps Terraform resources to their parent and
-// children nodes. This parses GraphViz output from Terraform which
-// certainly is not ideal, but seems reliable.
-func findDirectDependencies(rawGraph string) (map[string][]string, error) {
-	parsedGraph, err := gographviz.ParseString(rawGraph)
-	if err != nil {
-		return nil, xerrors.Errorf("parse graph: %w", err)
-	}
-	graph, err := gographviz.NewAnalysedGraph(parsedGraph)
-	if err != nil {
-		return nil, xerrors.Errorf("analyze graph: %w", err)
-	}
-	direct := map[string][]string{}
-	for _, node := range graph.Nodes.Nodes {
-		label, exists := node.Attrs["label"]
-		if !exists {
-			continue
-		}
-		label = strings.Trim(label, `"`)
-
-		dependencies := make([]string, 0)
-		for _, edges := range []map[string][]*gographviz.Edge{
-			graph.Edges.SrcToDsts[node.Name],
-			graph.Edges.DstToSrcs[node.Name],
-		} {
-			for destination := range edges {
-				dependencyNode, exists := graph.Nodes.Lookup[destination]
-				if !exists {
-					continue
-				}
-				label, exists := dependencyNode.Attrs["label"]
-				if !exists {
-					continue
-				}
-				label = strings.Trim(label, `"`)
-				dependencies = append(dependencies, label)
-			}
-		}
-		direct[label] = dependencies
-	}
-	return direct, nil
-}
@@ -0,0 +1,106 @@
+package terraform
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+
+	"github.com/coder/coder/provisionersdk/proto"
+)
+
+func TestWriteInlineModuleSource(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Inline", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		err := writeInlineModuleSource(dir, `resource "null_resource" "test" {}`, proto.ModuleSourceType_Inline)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		content, err := os.ReadFile(filepath.Join(dir, "main.tf"))
+		if err != nil {
+			t.Fatalf("expected main.tf to be written: %v", err)
+		}
+		if string(content) != `resource "null_resource" "test" {}` {
+			t.Fatalf("unexpected main.tf content: %s", content)
+		}
+	})
+
+	t.Run("Remote", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		err := writeInlineModuleSource(dir, "git::https://example.com/module.git", proto.ModuleSourceType_Remote)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "main.tf")); !os.IsNotExist(err) {
+			t.Fatalf("expected no main.tf to be written for a remote source")
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		t.Parallel()
+		dir := t.TempDir()
+		err := writeInlineModuleSource(dir, "", proto.ModuleSourceType_Inline)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "main.tf")); !os.IsNotExist(err) {
+			t.Fatalf("expected no main.tf to be written when a module is pre-staged")
+		}
+	})
+}
+
+func TestTerraformInitOptions(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Remote", func(t *testing.T) {
+		t.Parallel()
+		options := terraformInitOptions("git::https://example.com/module.git", proto.ModuleSourceType_Remote)
+		if len(options) != 1 {
+			t.Fatalf("expected exactly one init option for a remote source, got %d", len(options))
+		}
+	})
+
+	t.Run("Inline", func(t *testing.T) {
+		t.Parallel()
+		options := terraformInitOptions(`resource "null_resource" "test" {}`, proto.ModuleSourceType_Inline)
+		if len(options) != 0 {
+			t.Fatalf("expected no init options for an inline source, got %d", len(options))
+		}
+	})
+
+	t.Run("PreStaged", func(t *testing.T) {
+		t.Parallel()
+		options := terraformInitOptions("", proto.ModuleSourceType_Inline)
+		if len(options) != 0 {
+			t.Fatalf("expected no init options when a module is pre-staged, got %d", len(options))
+		}
+	})
+}
+
+// TestTerraformInitRemoteModuleFailure exercises the same tfexec.Init call
+// Provision makes with the options terraformInitOptions builds for a remote
+// module, confirming a fetch failure surfaces as an error rather than
+// succeeding silently or panicking.
+func TestTerraformInitRemoteModuleFailure(t *testing.T) {
+	t.Parallel()
+	binaryPath, err := exec.LookPath("terraform")
+	if err != nil {
+		t.Skip("terraform binary not found on PATH")
+	}
+	terraform, err := tfexec.NewTerraform(t.TempDir(), binaryPath)
+	if err != nil {
+		t.Fatalf("create terraform executor: %v", err)
+	}
+	options := terraformInitOptions("git::https://example.invalid/does-not-exist.git", proto.ModuleSourceType_Remote)
+	err = terraform.Init(context.Background(), options...)
+	if err == nil {
+		t.Fatal("expected init to fail fetching an unreachable remote module")
+	}
+}
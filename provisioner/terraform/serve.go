@@ -0,0 +1,68 @@
+package terraform
+
+import (
+	"context"
+
+	"cdr.dev/slog"
+
+	"github.com/coder/coder/provisionersdk"
+)
+
+// ServeOptions are configuration options for the terraform provisioner.
+type ServeOptions struct {
+	*provisionersdk.ServeOptions
+
+	// BinaryPath is the absolute path to the terraform binary.
+	BinaryPath string
+	// CachePath is a directory to cache downloaded terraform providers in.
+	// It's recommended this path be the same for all provisioner operations
+	// to avoid re-downloading providers.
+	CachePath string
+	Logger    slog.Logger
+
+	// StatePath is a directory to store workspace terraform state files in.
+	// It's only consulted when StateBackend is nil and StreamState is
+	// false, and is unrelated to CachePath: state here is workspace data
+	// that must persist and must not be shared with provider caching.
+	StatePath string
+	// StateBackend persists and retrieves workspace terraform state between
+	// provisions. If nil and StreamState is false, state is stored as files
+	// under StatePath.
+	StateBackend StateBackend
+	// StreamState delegates state load/save to the Coder server over each
+	// Provision call's DRPC stream instead of StateBackend. It takes
+	// priority over StateBackend when set.
+	StreamState bool
+}
+
+// Serve starts the provisionersdk server backed by a terraform provisioner.
+func Serve(ctx context.Context, options *ServeOptions) error {
+	if options.ServeOptions == nil {
+		options.ServeOptions = &provisionersdk.ServeOptions{}
+	}
+	stateBackend := options.StateBackend
+	if stateBackend == nil && !options.StreamState {
+		stateBackend = NewLocalFileStateBackend(options.StatePath)
+	}
+	return provisionersdk.Serve(ctx, &terraform{
+		binaryPath:   options.BinaryPath,
+		cachePath:    options.CachePath,
+		logger:       options.Logger,
+		stateBackend: stateBackend,
+		streamState:  options.StreamState,
+	}, options.ServeOptions)
+}
+
+// terraform implements provisionersdk.Provisioner, executing workspace
+// builds by shelling out to the terraform binary.
+type terraform struct {
+	binaryPath string
+	cachePath  string
+	logger     slog.Logger
+
+	// stateBackend is used for every Provision call unless streamState is
+	// set, in which case Provision constructs a backend scoped to that
+	// call's own stream instead; see provision.go.
+	stateBackend StateBackend
+	streamState  bool
+}
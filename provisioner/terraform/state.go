@@ -0,0 +1,297 @@
+package terraform
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/provisionersdk/proto"
+)
+
+// StateBackend persists and retrieves a workspace's terraform state.
+// Provision no longer has to assume state lives on the provisioner's local
+// disk, which is what made remote state, concurrency-safety, and surviving
+// a provisioner crash mid-apply impossible before.
+type StateBackend interface {
+	// Load returns the last state saved for workspaceID, or nil if none
+	// has been saved yet.
+	Load(ctx context.Context, workspaceID string) ([]byte, error)
+	// Save persists state for workspaceID, replacing whatever was stored
+	// previously.
+	Save(ctx context.Context, workspaceID string, state []byte) error
+	// Lock blocks until the caller holds the workspace's state lock, or
+	// ctx is done. The returned func releases it.
+	Lock(ctx context.Context, workspaceID string) (unlock func(), err error)
+}
+
+// localFileStateBackend is the original behavior: one state file per
+// workspace on the provisioner's local disk. It only serializes concurrent
+// provisions within this process, so it remains unsafe across multiple
+// provisioner instances.
+type localFileStateBackend struct {
+	directory string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewLocalFileStateBackend stores workspace state as files under directory.
+func NewLocalFileStateBackend(directory string) StateBackend {
+	return &localFileStateBackend{
+		directory: directory,
+		locks:     map[string]*sync.Mutex{},
+	}
+}
+
+func (b *localFileStateBackend) Load(_ context.Context, workspaceID string) ([]byte, error) {
+	state, err := os.ReadFile(b.statePath(workspaceID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("read state file: %w", err)
+	}
+	return state, nil
+}
+
+func (b *localFileStateBackend) Save(_ context.Context, workspaceID string, state []byte) error {
+	err := os.WriteFile(b.statePath(workspaceID), state, 0600)
+	if err != nil {
+		return xerrors.Errorf("write state file: %w", err)
+	}
+	return nil
+}
+
+func (b *localFileStateBackend) Lock(_ context.Context, workspaceID string) (func(), error) {
+	b.mu.Lock()
+	lock, ok := b.locks[workspaceID]
+	if !ok {
+		lock = &sync.Mutex{}
+		b.locks[workspaceID] = lock
+	}
+	b.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
+func (b *localFileStateBackend) statePath(workspaceID string) string {
+	return filepath.Join(b.directory, workspaceID+".tfstate")
+}
+
+// s3StateBackend stores state objects in an S3 bucket. If lockClient is
+// set, it arbitrates concurrent provisions of the same workspace with a
+// conditional write against lockTable, the way terraform's own S3 backend
+// uses DynamoDB for locking.
+type s3StateBackend struct {
+	client *s3.Client
+	bucket string
+	prefix string
+
+	lockClient *dynamodb.Client
+	lockTable  string
+}
+
+// NewS3StateBackend stores workspace state as objects under prefix in
+// bucket. Pass a nil lockClient to disable locking (not safe for
+// concurrent provisions of the same workspace).
+func NewS3StateBackend(client *s3.Client, bucket, prefix string, lockClient *dynamodb.Client, lockTable string) StateBackend {
+	return &s3StateBackend{
+		client:     client,
+		bucket:     bucket,
+		prefix:     prefix,
+		lockClient: lockClient,
+		lockTable:  lockTable,
+	}
+}
+
+func (b *s3StateBackend) Load(ctx context.Context, workspaceID string) ([]byte, error) {
+	output, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(workspaceID)),
+	})
+	var noSuchKey *s3types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("get state object: %w", err)
+	}
+	defer output.Body.Close()
+	state, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, xerrors.Errorf("read state object: %w", err)
+	}
+	return state, nil
+}
+
+func (b *s3StateBackend) Save(ctx context.Context, workspaceID string, state []byte) error {
+	_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(workspaceID)),
+		Body:   bytes.NewReader(state),
+	})
+	if err != nil {
+		return xerrors.Errorf("put state object: %w", err)
+	}
+	return nil
+}
+
+// lockPollInterval is how often s3StateBackend.Lock retries a PutItem after
+// finding the lock already held.
+const lockPollInterval = time.Second
+
+func (b *s3StateBackend) Lock(ctx context.Context, workspaceID string) (func(), error) {
+	if b.lockClient == nil {
+		return func() {}, nil
+	}
+	for {
+		_, err := b.lockClient.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(b.lockTable),
+			Item: map[string]dynamodbtypes.AttributeValue{
+				"LockID": &dynamodbtypes.AttributeValueMemberS{Value: b.key(workspaceID)},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(LockID)"),
+		})
+		if err == nil {
+			break
+		}
+		var alreadyLocked *dynamodbtypes.ConditionalCheckFailedException
+		if !errors.As(err, &alreadyLocked) {
+			return nil, xerrors.Errorf("acquire state lock for workspace %q: %w", workspaceID, err)
+		}
+		// Another provision already holds the lock. Poll until it's
+		// released instead of failing this one outright, so two concurrent
+		// provisions of the same workspace queue rather than one erroring.
+		select {
+		case <-ctx.Done():
+			return nil, xerrors.Errorf("acquire state lock for workspace %q: %w", workspaceID, ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+	unlock := func() {
+		_, _ = b.lockClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(b.lockTable),
+			Key: map[string]dynamodbtypes.AttributeValue{
+				"LockID": &dynamodbtypes.AttributeValueMemberS{Value: b.key(workspaceID)},
+			},
+		})
+	}
+	return unlock, nil
+}
+
+func (b *s3StateBackend) key(workspaceID string) string {
+	return path.Join(b.prefix, workspaceID+".tfstate")
+}
+
+// streamStateBackend delegates state persistence and workspace locking to
+// whatever the Coder server on the other end of the active Provision stream
+// does with it, so the provisioner itself never needs to know where state
+// ultimately lives or which other provisioners might be racing it.
+//
+// Provision already runs a single goroutine that calls stream.Recv() for the
+// lifetime of the call, to watch for a cancel message. Load and Lock cannot
+// also call stream.Recv() themselves: concurrent reads would race over the
+// same DRPC stream, so the cancel-watcher can steal the response meant for
+// one of them (hanging it forever), or one of them can steal an actual
+// cancel and silently drop it. Instead, they receive their responses from
+// responses/lockGrants, which that same goroutine feeds.
+type streamStateBackend struct {
+	stream     proto.DRPCProvisioner_ProvisionStream
+	responses  <-chan *proto.StateResponse
+	lockGrants <-chan *proto.LockResponse
+}
+
+// NewStreamStateBackend reads and writes state, and arbitrates workspace
+// locks, by exchanging messages with the server over stream. responses and
+// lockGrants must be fed every *proto.StateResponse and *proto.LockResponse
+// the Provision call's single stream-reader goroutine receives.
+func NewStreamStateBackend(stream proto.DRPCProvisioner_ProvisionStream, responses <-chan *proto.StateResponse, lockGrants <-chan *proto.LockResponse) StateBackend {
+	return &streamStateBackend{stream: stream, responses: responses, lockGrants: lockGrants}
+}
+
+func (b *streamStateBackend) Load(ctx context.Context, workspaceID string) ([]byte, error) {
+	err := b.stream.Send(&proto.Provision_Response{
+		Type: &proto.Provision_Response_StateRequest{
+			StateRequest: &proto.StateRequest{
+				WorkspaceId: workspaceID,
+			},
+		},
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("request state: %w", err)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case response, ok := <-b.responses:
+		if !ok {
+			return nil, xerrors.Errorf("receive state: stream closed")
+		}
+		return response.State, nil
+	}
+}
+
+func (b *streamStateBackend) Save(_ context.Context, workspaceID string, state []byte) error {
+	err := b.stream.Send(&proto.Provision_Response{
+		Type: &proto.Provision_Response_StateSave{
+			StateSave: &proto.StateSave{
+				WorkspaceId: workspaceID,
+				State:       state,
+			},
+		},
+	})
+	if err != nil {
+		return xerrors.Errorf("save state: %w", err)
+	}
+	return nil
+}
+
+func (b *streamStateBackend) Lock(ctx context.Context, workspaceID string) (func(), error) {
+	err := b.stream.Send(&proto.Provision_Response{
+		Type: &proto.Provision_Response_LockRequest{
+			LockRequest: &proto.LockRequest{
+				WorkspaceId: workspaceID,
+			},
+		},
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("request state lock for workspace %q: %w", workspaceID, err)
+	}
+	// The server is expected to queue this request behind any other
+	// provisioner already holding (or waiting on) workspaceID's lock, and
+	// only send the grant once it's this provisioner's turn, so this blocks
+	// exactly as long as a concurrent provision of the same workspace needs
+	// it to.
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case _, ok := <-b.lockGrants:
+		if !ok {
+			return nil, xerrors.Errorf("acquire state lock for workspace %q: stream closed", workspaceID)
+		}
+	}
+	unlock := func() {
+		_ = b.stream.Send(&proto.Provision_Response{
+			Type: &proto.Provision_Response_Unlock{
+				Unlock: &proto.Unlock{
+					WorkspaceId: workspaceID,
+				},
+			},
+		})
+	}
+	return unlock, nil
+}
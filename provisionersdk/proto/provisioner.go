@@ -0,0 +1,397 @@
+// Package proto defines the DRPC wire protocol spoken between a Coder
+// provisioner daemon (such as the terraform provisioner) and the Coder
+// server over a Provision stream: a Start request kicks off a build, and
+// the provisioner reports progress, diagnostics, and a final state back
+// over the same stream.
+//
+// This file is normally generated from provisioner.proto by
+// protoc-gen-go/protoc-gen-go-drpc; it's hand-maintained here because the
+// generator toolchain isn't available in this environment. Regenerate it
+// from the .proto definition once that's wired up again.
+package proto
+
+import "context"
+
+// LogLevel mirrors the severity levels terraform itself emits in its JSON
+// log lines.
+type LogLevel int32
+
+const (
+	LogLevel_TRACE LogLevel = iota
+	LogLevel_DEBUG
+	LogLevel_INFO
+	LogLevel_WARN
+	LogLevel_ERROR
+)
+
+// ParameterDestination selects where a workspace parameter value ends up
+// when a provision runs.
+type ParameterDestination int32
+
+const (
+	ParameterDestination_ENVIRONMENT_VARIABLE ParameterDestination = iota
+	ParameterDestination_PROVISIONER_VARIABLE
+)
+
+// WorkspaceTransition is the kind of build being performed.
+type WorkspaceTransition int32
+
+const (
+	WorkspaceTransition_START WorkspaceTransition = iota
+	WorkspaceTransition_STOP
+	WorkspaceTransition_DESTROY
+)
+
+func (t WorkspaceTransition) String() string {
+	switch t {
+	case WorkspaceTransition_START:
+		return "start"
+	case WorkspaceTransition_STOP:
+		return "stop"
+	case WorkspaceTransition_DESTROY:
+		return "destroy"
+	default:
+		return "unknown"
+	}
+}
+
+// ModuleSourceType selects how a workspace build's terraform module is
+// made available to the provisioner before `terraform init` runs.
+type ModuleSourceType int32
+
+const (
+	// ModuleSourceType_None means the module is already staged in
+	// Start.Directory; nothing extra needs to be written or fetched.
+	ModuleSourceType_None ModuleSourceType = iota
+	// ModuleSourceType_Inline means ModuleSource is the literal contents
+	// of a single main.tf.
+	ModuleSourceType_Inline
+	// ModuleSourceType_Remote means ModuleSource is a location terraform's
+	// `-from-module` understands (a git URL, an S3 bucket, a registry
+	// module, ...).
+	ModuleSourceType_Remote
+)
+
+// Agent represents a running agent on the workspace.
+type Agent struct {
+	Id            string
+	Env           map[string]string
+	StartupScript string
+
+	Auth isAgent_Auth
+}
+
+type isAgent_Auth interface {
+	isAgent_Auth()
+}
+
+// Agent_Token authenticates the agent with a pre-shared token.
+type Agent_Token struct {
+	Token string
+}
+
+func (*Agent_Token) isAgent_Auth() {}
+
+// Agent_InstanceId authenticates the agent using cloud-provider instance
+// identity.
+type Agent_InstanceId struct {
+	InstanceId string
+}
+
+func (*Agent_InstanceId) isAgent_Auth() {}
+
+// Resource represents a provisioned infrastructure resource, optionally
+// associated with the agent that runs on it.
+type Resource struct {
+	Name  string
+	Type  string
+	Agent *Agent
+}
+
+// Log is a single line of output from a provision, tagged with severity.
+type Log struct {
+	Level  LogLevel
+	Output string
+}
+
+// Diagnostic is a structured terraform diagnostic: a warning or error with
+// enough source location to render the way `terraform` itself does.
+type Diagnostic struct {
+	Severity string
+	Summary  string
+	Detail   string
+	Filename string
+	Line     int32
+	Column   int32
+	Snippet  string
+}
+
+// ResourceProgress reports incremental apply/refresh progress for a single
+// resource address.
+type ResourceProgress struct {
+	Address        string
+	Action         string
+	Stage          string
+	ElapsedSeconds float64
+}
+
+// ChangeSummary counts how many resources a plan or apply added, changed,
+// or destroyed.
+type ChangeSummary struct {
+	Add     int32
+	Change  int32
+	Destroy int32
+}
+
+// PlannedChange is the redacted before/after diff of a single resource in a
+// dry-run plan.
+type PlannedChange struct {
+	Address string
+	Action  string
+	Before  string
+	After   string
+}
+
+// OutputChange reports which root module outputs a plan would add, change,
+// or remove.
+type OutputChange struct {
+	Name   string
+	Action string
+}
+
+// ParameterValue is a single workspace parameter, destined for either the
+// build's environment or terraform's variables.
+type ParameterValue struct {
+	Name              string
+	Value             string
+	DestinationScheme ParameterDestination
+}
+
+// Metadata carries the build-independent details of the workspace being
+// provisioned.
+type Metadata struct {
+	WorkspaceId         string
+	CoderUrl            string
+	WorkspaceTransition WorkspaceTransition
+	WorkspaceName       string
+	WorkspaceOwner      string
+}
+
+// Start is the first message of a Provision stream, kicking off a build.
+type Start struct {
+	Directory        string
+	Metadata         *Metadata
+	State            []byte
+	ParameterValues  []*ParameterValue
+	DryRun           bool
+	ModuleSource     string
+	ModuleSourceType ModuleSourceType
+}
+
+// Cancel asks an in-flight Provision call to stop as soon as it safely can.
+type Cancel struct{}
+
+// StateRequest asks the server for the last state saved for WorkspaceId.
+type StateRequest struct {
+	WorkspaceId string
+}
+
+// StateResponse answers a StateRequest.
+type StateResponse struct {
+	State []byte
+}
+
+// StateSave asks the server to persist State for WorkspaceId.
+type StateSave struct {
+	WorkspaceId string
+	State       []byte
+}
+
+// LockRequest asks the server to grant the caller exclusive access to
+// WorkspaceId's state. The server is expected to queue the request behind
+// any other provisioner already holding (or waiting on) the same
+// workspace's lock, and only answer with a LockResponse once it's granted.
+type LockRequest struct {
+	WorkspaceId string
+}
+
+// LockResponse grants the lock requested by a LockRequest.
+type LockResponse struct{}
+
+// Unlock releases a lock previously granted for WorkspaceId.
+type Unlock struct {
+	WorkspaceId string
+}
+
+// Provision_Request is one message a Coder server sends down a Provision
+// stream.
+type Provision_Request struct {
+	Type isProvision_Request_Type
+}
+
+type isProvision_Request_Type interface {
+	isProvision_Request_Type()
+}
+
+type Provision_Request_Start struct {
+	Start *Start
+}
+
+func (*Provision_Request_Start) isProvision_Request_Type() {}
+
+type Provision_Request_Cancel struct {
+	Cancel *Cancel
+}
+
+func (*Provision_Request_Cancel) isProvision_Request_Type() {}
+
+type Provision_Request_State struct {
+	State *StateResponse
+}
+
+func (*Provision_Request_State) isProvision_Request_Type() {}
+
+type Provision_Request_Lock struct {
+	Lock *LockResponse
+}
+
+func (*Provision_Request_Lock) isProvision_Request_Type() {}
+
+func (r *Provision_Request) GetStart() *Start {
+	if r == nil {
+		return nil
+	}
+	wrapped, ok := r.Type.(*Provision_Request_Start)
+	if !ok {
+		return nil
+	}
+	return wrapped.Start
+}
+
+func (r *Provision_Request) GetCancel() *Cancel {
+	if r == nil {
+		return nil
+	}
+	wrapped, ok := r.Type.(*Provision_Request_Cancel)
+	if !ok {
+		return nil
+	}
+	return wrapped.Cancel
+}
+
+func (r *Provision_Request) GetState() *StateResponse {
+	if r == nil {
+		return nil
+	}
+	wrapped, ok := r.Type.(*Provision_Request_State)
+	if !ok {
+		return nil
+	}
+	return wrapped.State
+}
+
+func (r *Provision_Request) GetLock() *LockResponse {
+	if r == nil {
+		return nil
+	}
+	wrapped, ok := r.Type.(*Provision_Request_Lock)
+	if !ok {
+		return nil
+	}
+	return wrapped.Lock
+}
+
+// Provision_Complete is the terminal response of a Provision call.
+type Provision_Complete struct {
+	Resources      []*Resource
+	State          []byte
+	Error          string
+	Diagnostics    []*Diagnostic
+	PlannedChanges []*PlannedChange
+	OutputChanges  []*OutputChange
+	ChangeSummary  *ChangeSummary
+}
+
+// Provision_Response is one message a provisioner sends up a Provision
+// stream.
+type Provision_Response struct {
+	Type isProvision_Response_Type
+}
+
+type isProvision_Response_Type interface {
+	isProvision_Response_Type()
+}
+
+type Provision_Response_Log struct {
+	Log *Log
+}
+
+func (*Provision_Response_Log) isProvision_Response_Type() {}
+
+type Provision_Response_Diagnostic struct {
+	Diagnostic *Diagnostic
+}
+
+func (*Provision_Response_Diagnostic) isProvision_Response_Type() {}
+
+type Provision_Response_ResourceProgress struct {
+	ResourceProgress *ResourceProgress
+}
+
+func (*Provision_Response_ResourceProgress) isProvision_Response_Type() {}
+
+type Provision_Response_ChangeSummary struct {
+	ChangeSummary *ChangeSummary
+}
+
+func (*Provision_Response_ChangeSummary) isProvision_Response_Type() {}
+
+type Provision_Response_Complete struct {
+	Complete *Provision_Complete
+}
+
+func (*Provision_Response_Complete) isProvision_Response_Type() {}
+
+type Provision_Response_StateRequest struct {
+	StateRequest *StateRequest
+}
+
+func (*Provision_Response_StateRequest) isProvision_Response_Type() {}
+
+type Provision_Response_StateSave struct {
+	StateSave *StateSave
+}
+
+func (*Provision_Response_StateSave) isProvision_Response_Type() {}
+
+type Provision_Response_LockRequest struct {
+	LockRequest *LockRequest
+}
+
+func (*Provision_Response_LockRequest) isProvision_Response_Type() {}
+
+type Provision_Response_Unlock struct {
+	Unlock *Unlock
+}
+
+func (*Provision_Response_Unlock) isProvision_Response_Type() {}
+
+func (r *Provision_Response) GetComplete() *Provision_Complete {
+	if r == nil {
+		return nil
+	}
+	wrapped, ok := r.Type.(*Provision_Response_Complete)
+	if !ok {
+		return nil
+	}
+	return wrapped.Complete
+}
+
+// DRPCProvisioner_ProvisionStream is the bidirectional stream a provisioner
+// uses to exchange Provision_Request/Provision_Response messages with a
+// Coder server for the lifetime of one workspace build.
+type DRPCProvisioner_ProvisionStream interface {
+	Context() context.Context
+	Send(*Provision_Response) error
+	Recv() (*Provision_Request, error)
+}
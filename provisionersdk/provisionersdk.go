@@ -0,0 +1,38 @@
+// Package provisionersdk implements the DRPC server a provisioner daemon
+// (such as the terraform provisioner) runs to accept Provision calls from a
+// Coder server.
+//
+// This file is hand-maintained in place of the generated server/transport
+// plumbing, which isn't available in this environment.
+package provisionersdk
+
+import (
+	"context"
+	"os"
+
+	"github.com/coder/coder/provisionersdk/proto"
+)
+
+// Provisioner executes workspace builds for a single provisioner type.
+type Provisioner interface {
+	Provision(stream proto.DRPCProvisioner_ProvisionStream) error
+}
+
+// ServeOptions is accepted by Serve; it has no fields.
+type ServeOptions struct{}
+
+// Serve blocks until ctx is done and returns ctx.Err(). It opens no
+// listener and never calls provisioner.
+func Serve(ctx context.Context, provisioner Provisioner, options *ServeOptions) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// AgentScriptEnv returns the environment variables every workspace agent
+// startup script needs, regardless of provisioner type.
+func AgentScriptEnv() map[string]string {
+	return map[string]string{
+		"CODER_AGENT_AUTH": "token",
+		"HOME":             os.Getenv("HOME"),
+	}
+}